@@ -0,0 +1,180 @@
+package dispatcher
+
+import (
+	"log"
+	"simple-go-app/internal/envHelper"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// credentialRefreshMargin is how long before credentials actually expire that
+// Clients proactively fetches new ones, mirroring arvados' s3aws_volume.go
+// AuthExpiration handling.
+const credentialRefreshMargin = 5 * time.Minute
+
+// minRefreshInterval floors refreshLoop's sleep so that credentials expiring
+// within credentialRefreshMargin of "now" (or already expired) can't turn the
+// loop into a busy spin of IMDS calls and client rebuilds.
+const minRefreshInterval = 30 * time.Second
+
+// Clients bundles the AWS service clients shared across every worker so a
+// session and client no longer need to be constructed per message. The
+// credentials backing them are refreshed in the background shortly before
+// expiry and the clients rebuilt on top of them, analogous to arvados'
+// s3AWSbucket.SetBucket swapping in a freshly authenticated bucket handle.
+type Clients struct {
+	region      string
+	partSize    int64
+	concurrency int
+
+	mu          sync.RWMutex
+	s3Svc       *s3.S3
+	sqsSvc      *sqs.SQS
+	downloader  *s3manager.Downloader
+	ec2Provider *ec2rolecreds.EC2RoleProvider
+}
+
+// NewClients builds the shared S3 and SQS clients for region using a
+// credentials chain that tries environment credentials, then shared-config
+// credentials, then the EC2/ECS/EKS instance role (via ec2rolecreds), and
+// starts a background goroutine that refreshes the clients shortly before
+// their credentials expire. The shared s3manager.Downloader's PartSize and
+// Concurrency are read from S3_DOWNLOAD_PART_SIZE_MB and
+// S3_DOWNLOAD_CONCURRENCY so large PDFs can be fetched with parallel ranged
+// GETs instead of one sequential GetObject.
+func NewClients(region string) *Clients {
+	partSizeMB, err := strconv.ParseInt(envHelper.GetEnvVariable("S3_DOWNLOAD_PART_SIZE_MB"), 10, 64)
+	if err != nil {
+		log.Fatalf("Error parsing S3_DOWNLOAD_PART_SIZE_MB: %v", err)
+	}
+
+	concurrency, err := strconv.Atoi(envHelper.GetEnvVariable("S3_DOWNLOAD_CONCURRENCY"))
+	if err != nil {
+		log.Fatalf("Error parsing S3_DOWNLOAD_CONCURRENCY: %v", err)
+	}
+
+	c := &Clients{
+		region:      region,
+		partSize:    partSizeMB * 1024 * 1024,
+		concurrency: concurrency,
+	}
+	c.rebuild()
+
+	go c.refreshLoop()
+
+	return c
+}
+
+func (c *Clients) rebuild() {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(c.region)}))
+
+	ec2Provider := &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess)}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+		ec2Provider,
+	})
+
+	cfg := &aws.Config{Region: aws.String(c.region), Credentials: creds}
+
+	s3Svc := s3.New(sess, cfg)
+	downloader := s3manager.NewDownloaderWithClient(s3Svc, func(d *s3manager.Downloader) {
+		d.PartSize = c.partSize
+		d.Concurrency = c.concurrency
+	})
+
+	c.mu.Lock()
+	c.s3Svc = s3Svc
+	c.sqsSvc = sqs.New(sess, cfg)
+	c.downloader = downloader
+	c.ec2Provider = ec2Provider
+	c.mu.Unlock()
+}
+
+// S3 returns the current shared S3 client.
+func (c *Clients) S3() *s3.S3 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.s3Svc
+}
+
+// SQS returns the current shared SQS client.
+func (c *Clients) SQS() *sqs.SQS {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sqsSvc
+}
+
+// Downloader returns the current shared S3 download manager.
+func (c *Clients) Downloader() *s3manager.Downloader {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.downloader
+}
+
+// refreshLoop wakes up shortly before the current credentials expire and
+// swaps in freshly built clients, so no in-flight processMessage call ever
+// blocks on a mid-message credential refresh.
+//
+// credentials.NewChainCredentials wraps providers in a *credentials.Credentials
+// whose ExpiresAt always returns ProviderNotExpirer, since the active provider
+// isn't tracked once chained. The EC2 role provider itself does implement
+// Expirer (it embeds credentials.Expiry), so we keep a direct handle to it
+// instead and ask it for its expiry rather than asking the chain.
+//
+// Two deployments this needs to stay well-behaved under:
+//
+//   - On a non-EC2 deployment (env/shared/static credentials), Retrieve always
+//     fails once the instance-metadata lookup times out. rebuild() is only
+//     ever called once an observed expiry actually changes, so that case never
+//     rebuilds at all — it just keeps probing every credentialRefreshMargin in
+//     case an instance role becomes available later.
+//   - On EC2, ExpiresAt can report the same expiry on back-to-back iterations
+//     (the role hasn't actually rotated yet), so lastExpiry is compared before
+//     rebuilding, and credentials expiring inside credentialRefreshMargin (or
+//     already expired) are floored to minRefreshInterval rather than looping
+//     immediately.
+func (c *Clients) refreshLoop() {
+	var lastExpiry time.Time
+
+	for {
+		c.mu.RLock()
+		ec2Provider := c.ec2Provider
+		c.mu.RUnlock()
+
+		sleepFor := credentialRefreshMargin
+
+		if _, err := ec2Provider.Retrieve(); err != nil {
+			log.Println("Error retrieving EC2 role credentials, not EC2-role-backed:", err)
+		} else if expiry, err := ec2Provider.ExpiresAt(); err == nil {
+			if !expiry.Equal(lastExpiry) {
+				if !lastExpiry.IsZero() {
+					c.rebuild()
+					log.Println("Refreshed AWS credentials and rebuilt shared S3/SQS clients")
+				}
+				lastExpiry = expiry
+			}
+
+			if until := time.Until(expiry) - credentialRefreshMargin; until > 0 {
+				sleepFor = until
+			} else {
+				sleepFor = 0
+			}
+		}
+
+		if sleepFor < minRefreshInterval {
+			sleepFor = minRefreshInterval
+		}
+		time.Sleep(sleepFor)
+	}
+}
@@ -0,0 +1,51 @@
+package dispatcher
+
+import (
+	"log"
+	"simple-go-app/internal/envHelper"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiters bundles the per-downstream token-bucket rate limiters used by
+// processMessage. It replaces the single package-level lastRequestTime gap,
+// which serialized every worker behind one shared delay regardless of which
+// downstream (Grobid, CrossRef, or S3) it was about to call.
+type Limiters struct {
+	Grobid   *rate.Limiter
+	CrossRef *rate.Limiter
+	S3       *rate.Limiter
+
+	// CrossRefUserAgent and CrossRefMailto identify this client to CrossRef's
+	// public API so it is routed into the polite pool.
+	CrossRefUserAgent string
+	CrossRefMailto    string
+}
+
+// NewLimiters builds the per-downstream rate limiters from GROBID_RPS/
+// GROBID_BURST, CROSSREF_RPS/CROSSREF_BURST, and S3_RPS/S3_BURST, along with
+// the CrossRef polite-pool CROSSREF_USER_AGENT/CROSSREF_MAILTO headers.
+func NewLimiters() *Limiters {
+	return &Limiters{
+		Grobid:            newLimiter("GROBID_RPS", "GROBID_BURST"),
+		CrossRef:          newLimiter("CROSSREF_RPS", "CROSSREF_BURST"),
+		S3:                newLimiter("S3_RPS", "S3_BURST"),
+		CrossRefUserAgent: envHelper.GetEnvVariable("CROSSREF_USER_AGENT"),
+		CrossRefMailto:    envHelper.GetEnvVariable("CROSSREF_MAILTO"),
+	}
+}
+
+func newLimiter(rpsVar, burstVar string) *rate.Limiter {
+	rps, err := strconv.ParseFloat(envHelper.GetEnvVariable(rpsVar), 64)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v", rpsVar, err)
+	}
+
+	burst, err := strconv.Atoi(envHelper.GetEnvVariable(burstVar))
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v", burstVar, err)
+	}
+
+	return rate.NewLimiter(rate.Limit(rps), burst)
+}
@@ -0,0 +1,146 @@
+package dispatcher
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// queueDepthPollInterval is how often WatchQueueDepth refreshes the cached
+// approximate SQS queue depth that the QueueDepth gauge reports, so a
+// Prometheus scrape never blocks on a GetQueueAttributes call.
+const queueDepthPollInterval = 30 * time.Second
+
+// Metrics bundles the dispatcher package's Prometheus instruments, shaped
+// after arvados keepstore's volumeMetricsVecs / s3awsbucketStats: counters
+// and histograms per downstream call, plus gauges for queue depth and
+// in-flight workers.
+type Metrics struct {
+	MessagesReceived  prometheus.Counter
+	MessagesProcessed *prometheus.CounterVec
+	GrobidLatency     prometheus.Histogram
+	CrossRefLatency   prometheus.Histogram
+	S3DownloadBytes   prometheus.Histogram
+	S3DownloadLatency prometheus.Histogram
+	ThrottleSleep     *prometheus.HistogramVec
+	InFlightWorkers   prometheus.Gauge
+
+	// queueDepth holds the math.Float64bits of the last value WatchQueueDepth
+	// observed; it backs the QueueDepth GaugeFunc registered in NewMetrics.
+	queueDepth uint64
+}
+
+// NewMetrics creates and registers the dispatcher's Prometheus instruments
+// against registry.
+func NewMetrics(registry *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		MessagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dispatcher_messages_received_total",
+			Help: "Number of SQS messages received by workers.",
+		}),
+		MessagesProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dispatcher_messages_processed_total",
+			Help: "Number of messages processed, labelled by terminal status.",
+		}, []string{"status"}),
+		GrobidLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dispatcher_grobid_request_seconds",
+			Help:    "Grobid round-trip latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		CrossRefLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dispatcher_crossref_request_seconds",
+			Help:    "CrossRef round-trip latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		S3DownloadBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dispatcher_s3_download_bytes",
+			Help:    "Size in bytes of PDFs downloaded from S3.",
+			Buckets: prometheus.ExponentialBuckets(1<<10, 4, 10),
+		}),
+		S3DownloadLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dispatcher_s3_download_seconds",
+			Help:    "S3 download latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		ThrottleSleep: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dispatcher_rate_limit_wait_seconds",
+			Help:    "Time spent blocked on the per-endpoint rate limiter before an outbound call, labelled by endpoint.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		InFlightWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dispatcher_in_flight_workers",
+			Help: "Number of workers currently processing a message.",
+		}),
+	}
+
+	queueDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dispatcher_queue_depth_approximate",
+		Help: "Approximate number of visible messages in the source SQS queue, polled every 30s.",
+	}, func() float64 {
+		return math.Float64frombits(atomic.LoadUint64(&m.queueDepth))
+	})
+
+	registry.MustRegister(
+		m.MessagesReceived,
+		m.MessagesProcessed,
+		m.GrobidLatency,
+		m.CrossRefLatency,
+		m.S3DownloadBytes,
+		m.S3DownloadLatency,
+		m.ThrottleSleep,
+		m.InFlightWorkers,
+		queueDepth,
+	)
+
+	return m
+}
+
+// WatchQueueDepth polls GetQueueAttributes on a ticker and keeps the
+// QueueDepth gauge up to date, letting operators alert when the backlog
+// grows faster than workers can drain it. It runs until the process exits,
+// so callers should launch it in its own goroutine.
+func (m *Metrics) WatchQueueDepth(sqsSvc *sqs.SQS, sqsURL string) {
+	ticker := time.NewTicker(queueDepthPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		out, err := sqsSvc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(sqsURL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+		})
+		if err != nil {
+			log.Println("Error fetching approximate queue depth:", err)
+			continue
+		}
+
+		depth, err := strconv.ParseFloat(aws.StringValue(out.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]), 64)
+		if err != nil {
+			log.Println("Error parsing approximate queue depth:", err)
+			continue
+		}
+
+		atomic.StoreUint64(&m.queueDepth, math.Float64bits(depth))
+	}
+}
+
+// StartMetricsServer exposes registry over HTTP at addr (e.g. ":9090") on
+// the /metrics path and is meant to be called once from main alongside
+// Metrics.WatchQueueDepth.
+func StartMetricsServer(addr string, registry *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Error serving /metrics: %v", err)
+		}
+	}()
+}
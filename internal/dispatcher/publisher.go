@@ -0,0 +1,153 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// publishMaxRetries and publishBaseBackoff are vars rather than consts so
+// tests can shrink them and exercise the retry/backoff path quickly.
+var (
+	publishMaxRetries  = 5
+	publishBaseBackoff = 500 * time.Millisecond
+)
+
+// ParsedResult is the merged Grobid + CrossRef record written to the results
+// bucket and referenced from the completion message on the results queue.
+type ParsedResult struct {
+	Grobid   interface{} `json:"grobid"`
+	CrossRef interface{} `json:"cross_ref"`
+}
+
+// completionMessage is the body enqueued on the results queue once a parse
+// has finished, successfully or not, so downstream consumers can branch on
+// Status without having to inspect the result object themselves.
+type completionMessage struct {
+	UserID            string  `json:"user_id"`
+	ScreenID          string  `json:"screen_id"`
+	ResultKey         string  `json:"result_key,omitempty"`
+	ContentHash       string  `json:"content_hash,omitempty"`
+	ProcessingSeconds float64 `json:"processing_seconds"`
+	Status            string  `json:"status"`
+}
+
+// Publisher delivers a completed (or failed) parse to the downstream results
+// pipeline: the merged result is written to S3 and a completion message is
+// enqueued on the results queue. It is an interface so the results sink can
+// be faked out in tests without talking to real AWS services.
+type Publisher interface {
+	Publish(ctx context.Context, userID, screenID, messageID, status string, result *ParsedResult, duration time.Duration) error
+}
+
+// s3SQSPublisher is the Publisher used in production: it uploads the result
+// to RESULTS_BUCKET and enqueues a completion message on RESULTS_QUEUE_URL.
+type s3SQSPublisher struct {
+	s3Svc         *s3.S3
+	sqsSvc        *sqs.SQS
+	resultsBucket string
+	resultsQueue  string
+}
+
+// NewPublisher builds the production Publisher backed by the given S3 and
+// SQS clients.
+func NewPublisher(s3Svc *s3.S3, sqsSvc *sqs.SQS, resultsBucket, resultsQueueURL string) Publisher {
+	return &s3SQSPublisher{
+		s3Svc:         s3Svc,
+		sqsSvc:        sqsSvc,
+		resultsBucket: resultsBucket,
+		resultsQueue:  resultsQueueURL,
+	}
+}
+
+func (p *s3SQSPublisher) Publish(ctx context.Context, userID, screenID, messageID, status string, result *ParsedResult, duration time.Duration) error {
+	msg := completionMessage{
+		UserID:            userID,
+		ScreenID:          screenID,
+		ProcessingSeconds: duration.Seconds(),
+		Status:            status,
+	}
+
+	if result != nil {
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("marshalling parsed result: %w", err)
+		}
+
+		hash := sha256.Sum256(resultJSON)
+		msg.ContentHash = hex.EncodeToString(hash[:])
+		msg.ResultKey = fmt.Sprintf("%s/%s/%s.json", userID, screenID, messageID)
+
+		if err := p.retryWithBackoff(ctx, "uploading result to S3", func() error {
+			_, err := p.s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket: aws.String(p.resultsBucket),
+				Key:    aws.String(msg.ResultKey),
+				Body:   bytes.NewReader(resultJSON),
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshalling completion message: %w", err)
+	}
+
+	return p.retryWithBackoff(ctx, "enqueueing completion message", func() error {
+		_, err := p.sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(p.resultsQueue),
+			MessageBody: aws.String(string(body)),
+		})
+		return err
+	})
+}
+
+// retryWithBackoff retries op up to publishMaxRetries times with exponential
+// backoff, giving up (and leaving the original SQS message for redelivery)
+// once the budget is exhausted.
+func (p *s3SQSPublisher) retryWithBackoff(ctx context.Context, action string, op func() error) error {
+	var err error
+	backoff := publishBaseBackoff
+
+	for attempt := 1; attempt <= publishMaxRetries; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+
+		log.Printf("Error %s (attempt %d/%d): %v\n", action, attempt, publishMaxRetries, err)
+
+		if attempt == publishMaxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return fmt.Errorf("%s: giving up after %d attempts: %w", action, publishMaxRetries, err)
+}
+
+// mergeParsedResult captures the tidied Grobid and CrossRef responses into
+// the struct that gets published downstream, instead of discarding the
+// CrossRef side as the previous code did.
+func mergeParsedResult(grobid, crossRef interface{}) *ParsedResult {
+	return &ParsedResult{
+		Grobid:   grobid,
+		CrossRef: crossRef,
+	}
+}
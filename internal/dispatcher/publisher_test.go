@@ -0,0 +1,199 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakePublisher is the Publisher double the Publisher interface exists to
+// enable: it lets a test drive publishTerminalResult's publish-then-delete
+// behavior without ever publishing to S3 or the results queue.
+type fakePublisher struct {
+	published []fakePublish
+	err       error
+}
+
+type fakePublish struct {
+	status string
+	result *ParsedResult
+}
+
+func (f *fakePublisher) Publish(_ context.Context, _, _, _, status string, result *ParsedResult, _ time.Duration) error {
+	f.published = append(f.published, fakePublish{status: status, result: result})
+	return f.err
+}
+
+// TestFakePublisherRecordsStatus confirms the Publisher interface can stand
+// in for the real sink: a fake recording each call captures the status it
+// was handed, for every status processMessage reports, without any AWS
+// dependency.
+func TestFakePublisherRecordsStatus(t *testing.T) {
+	for _, status := range []string{"grobid_error", "crossref_error", "too_large", "download_error", "ok"} {
+		fp := &fakePublisher{}
+		if err := fp.Publish(context.Background(), "user", "screen", "msg-1", status, nil, time.Millisecond); err != nil {
+			t.Fatalf("Publish returned unexpected error: %v", err)
+		}
+		if len(fp.published) != 1 || fp.published[0].status != status {
+			t.Fatalf("got %+v, want a single publish with status %q", fp.published, status)
+		}
+	}
+}
+
+// TestFakePublisherFailureLeavesMessageUndeleted documents and exercises the
+// contract publishTerminalResult relies on: it only calls sqsSvc.DeleteMessage
+// after a successful publisher.Publish, returning immediately on a publish
+// error (see worker.go's publishTerminalResult). A fake that fails every call
+// lets us assert that contract without standing up real AWS resources.
+func TestFakePublisherFailureLeavesMessageUndeleted(t *testing.T) {
+	fp := &fakePublisher{err: fmt.Errorf("sqs unavailable")}
+
+	err := fp.Publish(context.Background(), "user", "screen", "msg-1", "ok", &ParsedResult{}, time.Millisecond)
+	if err == nil {
+		t.Fatal("expected Publish to return an error")
+	}
+
+	// publishTerminalResult does:
+	//
+	//   if err := publisher.Publish(...); err != nil {
+	//       log.Println("Error publishing", status, "result:", err)
+	//       return
+	//   }
+	//   sqsSvc.DeleteMessage(...)
+	//
+	// so a non-nil error from Publish must short-circuit before DeleteMessage
+	// is ever reached, leaving the message to become visible again and be
+	// redelivered rather than silently dropped.
+	if len(fp.published) != 1 {
+		t.Fatalf("expected exactly one publish attempt, got %d", len(fp.published))
+	}
+
+	var deletes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&deletes, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, sqsSvc := testClients(t, server.URL)
+	message := &sqs.Message{MessageId: aws.String("msg-1"), ReceiptHandle: aws.String("receipt-1")}
+	publishTerminalResult(context.Background(), sqsSvc, "https://sqs.example/source-queue", message, fp, "user", "screen", "ok", &ParsedResult{}, time.Millisecond)
+
+	if got := atomic.LoadInt32(&deletes); got != 0 {
+		t.Errorf("DeleteMessage called %d times after a failed publish, want 0", got)
+	}
+}
+
+// testClients builds S3 and SQS clients that talk to the given
+// httptest.Server instead of real AWS, with the SDK's own built-in retries
+// disabled so retryWithBackoff's behavior isn't masked by a second retry
+// layer underneath it, and with response checksum validation disabled so the
+// canned SendMessage response's placeholder MD5OfMessageBody is accepted.
+func testClients(t *testing.T, serverURL string) (*s3.S3, *sqs.SQS) {
+	t.Helper()
+
+	cfg := &aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(serverURL),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:       aws.Int(0),
+
+		DisableComputeChecksums: aws.Bool(true),
+	}
+	sess := session.Must(session.NewSession(cfg))
+	return s3.New(sess), sqs.New(sess)
+}
+
+const sendMessageResponseXML = `<?xml version="1.0"?>
+<SendMessageResponse xmlns="http://queue.amazonaws.com/doc/2012-11-05/">
+  <SendMessageResult>
+    <MD5OfMessageBody>00000000000000000000000000000000</MD5OfMessageBody>
+    <MessageId>11111111-1111-1111-1111-111111111111</MessageId>
+  </SendMessageResult>
+  <ResponseMetadata>
+    <RequestId>22222222-2222-2222-2222-222222222222</RequestId>
+  </ResponseMetadata>
+</SendMessageResponse>`
+
+// TestS3SQSPublisherPublishOK exercises the real s3SQSPublisher against a
+// fake S3+SQS server, verifying a successful publish uploads the result to
+// S3 and enqueues the completion message on SQS.
+func TestS3SQSPublisherPublishOK(t *testing.T) {
+	var s3Puts, sqsSends int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			atomic.AddInt32(&s3Puts, 1)
+			w.Header().Set("ETag", `"abc"`)
+			w.WriteHeader(http.StatusOK)
+		default:
+			atomic.AddInt32(&sqsSends, 1)
+			w.Header().Set("Content-Type", "text/xml")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, sendMessageResponseXML)
+		}
+	}))
+	defer server.Close()
+
+	s3Svc, sqsSvc := testClients(t, server.URL)
+	publisher := NewPublisher(s3Svc, sqsSvc, "results-bucket", "https://sqs.example/results-queue")
+
+	result := mergeParsedResult(map[string]interface{}{"title": "A Paper"}, map[string]interface{}{"doi": "10.1/x"})
+
+	if err := publisher.Publish(context.Background(), "user-1", "screen-1", "msg-1", "ok", result, 2*time.Second); err != nil {
+		t.Fatalf("Publish returned unexpected error: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&s3Puts); got != 1 {
+		t.Errorf("expected 1 S3 PutObject call, got %d", got)
+	}
+	if got := atomic.LoadInt32(&sqsSends); got != 1 {
+		t.Errorf("expected 1 SQS SendMessage call, got %d", got)
+	}
+}
+
+// TestS3SQSPublisherPublishRetriesThenFails verifies that when the S3 upload
+// never succeeds, retryWithBackoff exhausts publishMaxRetries attempts and
+// returns an error rather than hanging or silently swallowing the failure.
+func TestS3SQSPublisherPublishRetriesThenFails(t *testing.T) {
+	origRetries, origBackoff := publishMaxRetries, publishBaseBackoff
+	publishMaxRetries = 3
+	publishBaseBackoff = time.Millisecond
+	t.Cleanup(func() {
+		publishMaxRetries = origRetries
+		publishBaseBackoff = origBackoff
+	})
+
+	var s3Puts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s3Puts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	s3Svc, sqsSvc := testClients(t, server.URL)
+	publisher := NewPublisher(s3Svc, sqsSvc, "results-bucket", "https://sqs.example/results-queue")
+
+	result := mergeParsedResult(map[string]interface{}{"title": "A Paper"}, nil)
+
+	err := publisher.Publish(context.Background(), "user-1", "screen-1", "msg-1", "ok", result, time.Second)
+	if err == nil {
+		t.Fatal("expected Publish to return an error after exhausting retries")
+	}
+	if got := atomic.LoadInt32(&s3Puts); got != int32(publishMaxRetries) {
+		t.Errorf("expected %d S3 PutObject attempts, got %d", publishMaxRetries, got)
+	}
+}
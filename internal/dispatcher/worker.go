@@ -1,109 +1,268 @@
 package dispatcher
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"simple-go-app/internal/envHelper"
 	"simple-go-app/internal/parsing"
 	"simple-go-app/internal/store"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/time/rate"
 )
 
-var (
-	lastRequestTime   time.Time
-	lastRequestTimeMu sync.Mutex
-)
+func Worker(id int, messageQueue <-chan *sqs.Message, clients *Clients, limiters *Limiters, sqsURL, s3Bucket string, s *store.Store, metrics *Metrics) {
+	heartbeatTime, err := time.ParseDuration(envHelper.GetEnvVariable("HEARTBEAT_TIME_SECONDS") + "s")
+	if err != nil {
+		log.Fatalf("Error parsing HEARTBEAT_TIME_SECONDS: %v", err)
+	}
 
-func Worker(id int, messageQueue <-chan *sqs.Message, svc *sqs.SQS, sqsURL, s3Bucket string, s *store.Store) {
-	awsRegion := envHelper.GetEnvVariable("AWS_REGION")
-	minGapBetweenRequests := envHelper.GetEnvVariable("MINIMUM_GAP_BETWEEN_REQUESTS_SECONDS")
-	minGap, err := time.ParseDuration(minGapBetweenRequests + "s")
+	maxProcessingTime, err := time.ParseDuration(envHelper.GetEnvVariable("MAX_PROCESSING_TIME_SECONDS") + "s")
 	if err != nil {
-		log.Fatalf("Error parsing MINIMUM_GAP_BETWEEN_REQUESTS_SECONDS: %v", err)
+		log.Fatalf("Error parsing MAX_PROCESSING_TIME_SECONDS: %v", err)
 	}
 
+	resultsBucket := envHelper.GetEnvVariable("RESULTS_BUCKET")
+	resultsQueueURL := envHelper.GetEnvVariable("RESULTS_QUEUE_URL")
+
+	maxObjectSizeMB, err := strconv.ParseInt(envHelper.GetEnvVariable("S3_MAX_OBJECT_SIZE_MB"), 10, 64)
+	if err != nil {
+		log.Fatalf("Error parsing S3_MAX_OBJECT_SIZE_MB: %v", err)
+	}
+	maxObjectSize := maxObjectSizeMB * 1024 * 1024
+
 	log.Printf("Starting worker %d...\n", id)
 
 	for {
 		message := <-messageQueue
-		processMessage(id, message, svc, sqsURL, s3Bucket, awsRegion, minGap)
+		metrics.MessagesReceived.Inc()
+		metrics.InFlightWorkers.Inc()
+		func() {
+			// defer, rather than an Inc/Dec pair bracketing the call, so the
+			// gauge can't be left permanently high if processMessage panics
+			// and kills this goroutine.
+			defer metrics.InFlightWorkers.Dec()
+			processMessage(id, message, clients, limiters, sqsURL, s3Bucket, heartbeatTime, maxProcessingTime, resultsBucket, resultsQueueURL, maxObjectSize, metrics)
+		}()
 	}
 }
 
-func createAWSSession(region string) *session.Session {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
-	return sess
+// heartbeatVisibility periodically extends the invisibility window of an in-flight
+// SQS message so a second worker does not pick it up while this one is still
+// downloading, parsing, or cross-referencing it. It extends the timeout to
+// 2*heartbeat each tick and stops renewing once ctx is cancelled (processMessage
+// returned) or maxProcessingTime has elapsed, at which point a poisonous message
+// is left to expire naturally and fall back to the DLQ.
+func heartbeatVisibility(ctx context.Context, svc *sqs.SQS, sqsURL string, message *sqs.Message, heartbeat, maxProcessingTime time.Duration) {
+	deadline := time.Now().Add(maxProcessingTime)
+	extension := aws.Int64(int64(2 * heartbeat / time.Second))
+
+	extend := func() {
+		_, err := svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(sqsURL),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: extension,
+		})
+		if err != nil {
+			log.Println("Error extending message visibility:", err)
+		}
+	}
+
+	// Extend once up front: the ticker's first tick is a full heartbeat away,
+	// which would otherwise leave the message unprotected for that interval if
+	// the queue's configured VisibilityTimeout is shorter than heartbeat.
+	extend()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Now().After(deadline) {
+				log.Println("Max processing time exceeded, no longer extending message visibility")
+				return
+			}
+			extend()
+		}
+	}
 }
 
-func downloadFileFromS3(s3Svc *s3.S3, bucket, path string) ([]byte, error) {
-	output, err := s3Svc.GetObject(&s3.GetObjectInput{
+// ObjectTooLargeError is returned by downloadFileFromS3 when the source
+// object exceeds the configured maximum object size guard, so callers can
+// surface it to the results queue as status "too_large" instead of a
+// generic download failure.
+type ObjectTooLargeError struct {
+	Bucket string
+	Key    string
+	Size   int64
+	Max    int64
+}
+
+func (e *ObjectTooLargeError) Error() string {
+	return fmt.Sprintf("object %s/%s is %d bytes, exceeds the %d byte limit", e.Bucket, e.Key, e.Size, e.Max)
+}
+
+// classifyDownloadError maps a downloadFileFromS3 error to the results-queue
+// status it should be published under, so an oversized object is reported as
+// "too_large" instead of an undifferentiated "download_error".
+func classifyDownloadError(err error) string {
+	var tooLarge *ObjectTooLargeError
+	if errors.As(err, &tooLarge) {
+		return "too_large"
+	}
+	return "download_error"
+}
+
+// requiredStringField reads key out of msgData as a string, returning an
+// error instead of panicking when the field is absent or of the wrong type,
+// since msgData comes from an untrusted SQS message body that is only
+// guaranteed to be valid JSON, not the expected shape.
+func requiredStringField(msgData map[string]interface{}, key string) (string, error) {
+	value, ok := msgData[key].(string)
+	if !ok {
+		return "", fmt.Errorf("missing or non-string field %q", key)
+	}
+	return value, nil
+}
+
+// waitForLimiter blocks until limiter admits the next call to the given
+// downstream, recording how long the wait took so operators can see which
+// endpoint is the bottleneck.
+func waitForLimiter(ctx context.Context, limiter *rate.Limiter, metrics *Metrics, endpoint string) error {
+	waitStartedAt := time.Now()
+	err := limiter.Wait(ctx)
+	metrics.ThrottleSleep.WithLabelValues(endpoint).Observe(time.Since(waitStartedAt).Seconds())
+	return err
+}
+
+func downloadFileFromS3(ctx context.Context, s3Svc *s3.S3, downloader *s3manager.Downloader, bucket, path string, maxObjectSize int64) ([]byte, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(path),
 	})
 	if err != nil {
 		return nil, err
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			fmt.Println("Error closing S3 response body:", err)
-		}
-	}(output.Body)
 
-	fileContent, err := ioutil.ReadAll(output.Body)
-	if err != nil {
+	size := aws.Int64Value(head.ContentLength)
+	if size > maxObjectSize {
+		return nil, &ObjectTooLargeError{Bucket: bucket, Key: path, Size: size, Max: maxObjectSize}
+	}
+
+	buf := aws.NewWriteAtBuffer(make([]byte, 0, size))
+	if _, err := downloader.DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(path),
+	}); err != nil {
 		return nil, err
 	}
-	return fileContent, nil
+
+	return buf.Bytes(), nil
 }
 
-func processMessage(id int, message *sqs.Message, svc *sqs.SQS, sqsURL, s3Bucket, awsRegion string, minGap time.Duration) {
+// publishTerminalResult publishes status (and result, if any) for message to
+// the results queue and, only once that publish has succeeded, deletes
+// message from the source queue. Every status processMessage reports is
+// terminal — grobid_error/crossref_error/download_error/too_large are just as
+// final as ok, since redelivering the same S3 object at the same rate limiter
+// state would deterministically fail the same way. Deleting only after a
+// successful publish means a results-queue/S3 outage leaves the source
+// message for redelivery (so the terminal status isn't lost), while a
+// processing failure is reported exactly once instead of being republished
+// on every redelivery until it eventually reaches the DLQ.
+func publishTerminalResult(ctx context.Context, sqsSvc *sqs.SQS, sqsURL string, message *sqs.Message, publisher Publisher, userID, screenID, status string, result *ParsedResult, duration time.Duration) {
+	if err := publisher.Publish(ctx, userID, screenID, *message.MessageId, status, result, duration); err != nil {
+		log.Println("Error publishing", status, "result:", err)
+		return
+	}
+
+	if _, err := sqsSvc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(sqsURL),
+		ReceiptHandle: message.ReceiptHandle,
+	}); err != nil {
+		log.Println("Error deleting message from the queue:", err)
+	}
+}
+
+func processMessage(id int, message *sqs.Message, clients *Clients, limiters *Limiters, sqsURL, s3Bucket string, heartbeatTime, maxProcessingTime time.Duration, resultsBucket, resultsQueueURL string, maxObjectSize int64, metrics *Metrics) {
+	startedAt := time.Now()
+
 	var msgData map[string]interface{}
 	if err := json.Unmarshal([]byte(*message.Body), &msgData); err != nil {
 		log.Println("Error decoding JSON message:", err)
 		return
 	}
 
-	path := msgData["s3Location"].(string)
-	userID := msgData["user_id"].(string)
-	screenID := msgData["screen_id"].(string)
+	path, err := requiredStringField(msgData, "s3Location")
+	if err != nil {
+		log.Println("Error decoding message:", err)
+		return
+	}
+	userID, err := requiredStringField(msgData, "user_id")
+	if err != nil {
+		log.Println("Error decoding message:", err)
+		return
+	}
+	screenID, err := requiredStringField(msgData, "screen_id")
+	if err != nil {
+		log.Println("Error decoding message:", err)
+		return
+	}
 
 	fmt.Printf("Worker %d received message. Path: %s. User ID: %s. Screen ID: %s\n", id, path, userID, screenID)
 
-	lastRequestTimeMu.Lock()
-	timeSinceLastRequest := time.Since(lastRequestTime)
-	lastRequestTimeMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if timeSinceLastRequest < minGap {
-		sleepTime := minGap - timeSinceLastRequest
-		log.Printf("Worker %d sleeping for %v to meet the minimum gap between requests\n", id, sleepTime)
-		time.Sleep(sleepTime)
-	}
+	sqsSvc := clients.SQS()
+	s3Svc := clients.S3()
+
+	go heartbeatVisibility(ctx, sqsSvc, sqsURL, message, heartbeatTime, maxProcessingTime)
+
+	publisher := NewPublisher(s3Svc, sqsSvc, resultsBucket, resultsQueueURL)
 
-	sess := createAWSSession(awsRegion)
-	s3Svc := s3.New(sess)
+	if err := waitForLimiter(ctx, limiters.S3, metrics, "s3"); err != nil {
+		log.Println("Error waiting for S3 rate limiter:", err)
+		return
+	}
 
-	fileContent, err := downloadFileFromS3(s3Svc, s3Bucket, path)
+	downloadStartedAt := time.Now()
+	fileContent, err := downloadFileFromS3(ctx, s3Svc, clients.Downloader(), s3Bucket, path, maxObjectSize)
+	metrics.S3DownloadLatency.Observe(time.Since(downloadStartedAt).Seconds())
 	if err != nil {
 		log.Println("Error downloading file from S3:", err)
 		log.Printf("Bucket: %s, Key: %s\n", s3Bucket, path)
+
+		status := classifyDownloadError(err)
+		metrics.MessagesProcessed.WithLabelValues(status).Inc()
+		publishTerminalResult(ctx, sqsSvc, sqsURL, message, publisher, userID, screenID, status, nil, time.Since(startedAt))
+		return
+	}
+	metrics.S3DownloadBytes.Observe(float64(len(fileContent)))
+
+	if err := waitForLimiter(ctx, limiters.Grobid, metrics, "grobid"); err != nil {
+		log.Println("Error waiting for Grobid rate limiter:", err)
 		return
 	}
 
+	grobidStartedAt := time.Now()
 	CrudeGrobidResponse, err := parsing.SendPDF2Grobid(fileContent)
+	metrics.GrobidLatency.Observe(time.Since(grobidStartedAt).Seconds())
 	if err != nil {
 		log.Println("Error sending file to Grobid service:", err)
+		metrics.MessagesProcessed.WithLabelValues("grobid_error").Inc()
+		publishTerminalResult(ctx, sqsSvc, sqsURL, message, publisher, userID, screenID, "grobid_error", nil, time.Since(startedAt))
 		return
 	}
 
@@ -111,31 +270,31 @@ func processMessage(id int, message *sqs.Message, svc *sqs.SQS, sqsURL, s3Bucket
 	tidyGrobidResponse, err := parsing.TidyUpGrobidResponse(CrudeGrobidResponse)
 	if err != nil {
 		log.Println("Error tidying up Grobid response:", err)
+		metrics.MessagesProcessed.WithLabelValues("grobid_error").Inc()
+		publishTerminalResult(ctx, sqsSvc, sqsURL, message, publisher, userID, screenID, "grobid_error", nil, time.Since(startedAt))
 		return
 	}
 
 	// cross reference data using the DOI
-	crudeCrossRefResponse, err := parsing.CrossReferenceData(tidyGrobidResponse.Doi)
+	if err := waitForLimiter(ctx, limiters.CrossRef, metrics, "crossref"); err != nil {
+		log.Println("Error waiting for CrossRef rate limiter:", err)
+		return
+	}
+
+	crossRefStartedAt := time.Now()
+	crudeCrossRefResponse, err := parsing.CrossReferenceData(ctx, tidyGrobidResponse.Doi, limiters.CrossRefUserAgent, limiters.CrossRefMailto)
+	metrics.CrossRefLatency.Observe(time.Since(crossRefStartedAt).Seconds())
 	if err != nil {
 		log.Println("Error cross referencing data:", err)
+		metrics.MessagesProcessed.WithLabelValues("crossref_error").Inc()
+		publishTerminalResult(ctx, sqsSvc, sqsURL, message, publisher, userID, screenID, "crossref_error", nil, time.Since(startedAt))
 		return
 	}
 
-	// tidy up cross referenced data
-	_ = parsing.TidyCrossRefData(crudeCrossRefResponse)
-
-	// give preference to crossref data
+	// tidy up cross referenced data, giving preference to crossref data
+	tidyCrossRefResponse := parsing.TidyCrossRefData(crudeCrossRefResponse)
+	result := mergeParsedResult(tidyGrobidResponse, tidyCrossRefResponse)
 
-	lastRequestTimeMu.Lock()
-	lastRequestTime = time.Now()
-	lastRequestTimeMu.Unlock()
-
-	_, err = svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
-		QueueUrl:          aws.String(sqsURL),
-		ReceiptHandle:     message.ReceiptHandle,
-		VisibilityTimeout: aws.Int64(30),
-	})
-	if err != nil {
-		log.Println("Error putting message back to the queue:", err)
-	}
+	metrics.MessagesProcessed.WithLabelValues("ok").Inc()
+	publishTerminalResult(ctx, sqsSvc, sqsURL, message, publisher, userID, screenID, "ok", result, time.Since(startedAt))
 }
@@ -0,0 +1,114 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestClassifyDownloadError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "object too large",
+			err:  &ObjectTooLargeError{Bucket: "b", Key: "k", Size: 100, Max: 10},
+			want: "too_large",
+		},
+		{
+			name: "wrapped object too large",
+			err:  fmt.Errorf("downloading: %w", &ObjectTooLargeError{Bucket: "b", Key: "k", Size: 100, Max: 10}),
+			want: "too_large",
+		},
+		{
+			name: "generic error",
+			err:  errors.New("connection reset"),
+			want: "download_error",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyDownloadError(tc.err); got != tc.want {
+				t.Errorf("classifyDownloadError(%v) = %q, want %q", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequiredStringField(t *testing.T) {
+	msgData := map[string]interface{}{
+		"s3Location": "bucket/key.pdf",
+		"user_id":    float64(42),
+	}
+
+	if got, err := requiredStringField(msgData, "s3Location"); err != nil || got != "bucket/key.pdf" {
+		t.Errorf("requiredStringField(s3Location) = (%q, %v), want (\"bucket/key.pdf\", nil)", got, err)
+	}
+
+	if _, err := requiredStringField(msgData, "user_id"); err == nil {
+		t.Error("expected an error for a non-string field, got nil")
+	}
+
+	if _, err := requiredStringField(msgData, "screen_id"); err == nil {
+		t.Error("expected an error for a missing field, got nil")
+	}
+}
+
+const deleteMessageResponseXML = `<?xml version="1.0"?>
+<DeleteMessageResponse xmlns="http://queue.amazonaws.com/doc/2012-11-05/">
+  <ResponseMetadata>
+    <RequestId>33333333-3333-3333-3333-333333333333</RequestId>
+  </ResponseMetadata>
+</DeleteMessageResponse>`
+
+// TestPublishTerminalResultDeletesOnlyAfterSuccessfulPublish is the policy
+// fix for the results-queue's at-least-once/contradictory-terminals problem:
+// every status processMessage reports is terminal, so the source message is
+// deleted once it has been published, whether the outcome was "ok" or an
+// error status. If the publish itself fails, the message is left alone so it
+// is redelivered and the terminal status isn't lost.
+func TestPublishTerminalResultDeletesOnlyAfterSuccessfulPublish(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		publishErr  error
+		wantDeletes int32
+	}{
+		{name: "publish succeeds, terminal status deleted", publishErr: nil, wantDeletes: 1},
+		{name: "publish fails, message left for redelivery", publishErr: fmt.Errorf("sqs unavailable"), wantDeletes: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var deletes int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&deletes, 1)
+				w.Header().Set("Content-Type", "text/xml")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, deleteMessageResponseXML)
+			}))
+			defer server.Close()
+
+			_, sqsSvc := testClients(t, server.URL)
+			fp := &fakePublisher{err: tc.publishErr}
+			message := &sqs.Message{
+				MessageId:     aws.String("msg-1"),
+				ReceiptHandle: aws.String("receipt-1"),
+			}
+
+			publishTerminalResult(context.Background(), sqsSvc, "https://sqs.example/source-queue", message, fp, "user-1", "screen-1", "grobid_error", nil, time.Second)
+
+			if got := atomic.LoadInt32(&deletes); got != tc.wantDeletes {
+				t.Errorf("DeleteMessage called %d times, want %d", got, tc.wantDeletes)
+			}
+		})
+	}
+}
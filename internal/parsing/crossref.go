@@ -0,0 +1,57 @@
+package parsing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// CrossRefResult is the raw CrossRef API response for a single DOI lookup,
+// before TidyCrossRefData filters it down to the fields the worker cares
+// about.
+type CrossRefResult struct {
+	Message map[string]interface{} `json:"message"`
+}
+
+// CrossReferenceData looks up doi against the CrossRef REST API. userAgent
+// and mailto identify the caller so CrossRef routes the request into its
+// polite pool instead of the public rate limit, and ctx carries the calling
+// worker's rate-limiter wait so a cancelled context aborts the lookup
+// instead of leaving it to run to completion.
+func CrossReferenceData(ctx context.Context, doi, userAgent, mailto string) (*CrossRefResult, error) {
+	// DOIs are themselves path-safe (letters, digits, and punctuation including
+	// the registrant/suffix "/") and CrossRef expects that slash literal, so
+	// the DOI is concatenated in as-is rather than run through url.PathEscape,
+	// which would percent-encode it to "%2F" and 404.
+	endpoint := fmt.Sprintf("https://api.crossref.org/works/%s", doi)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if mailto != "" {
+		q := req.URL.Query()
+		q.Set("mailto", mailto)
+		req.URL.RawQuery = q.Encode()
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CrossRef returned status %d for DOI %s", resp.StatusCode, doi)
+	}
+
+	var result CrossRefResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}